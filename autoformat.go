@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/discordapp/lilliput"
+)
+
+// autoFormatSources lists source formats eligible for -auto-format: opaque
+// PNG/GIF inputs are common in screenshot-heavy folders and often shrink
+// significantly once transcoded to JPEG.
+var autoFormatSources = map[string]bool{
+	".png": true,
+	".gif": true,
+}
+
+// tryJPEGAlternative re-runs the transform against a fresh decoder and
+// image-ops instance, encoding as JPEG instead of base.FileType, so the
+// caller can compare sizes and keep whichever is smaller.
+func tryJPEGAlternative(inputBuf []byte, base lilliput.ImageOptions) ([]byte, error) {
+	decoder, err := lilliput.NewDecoder(inputBuf)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	ops := lilliput.NewImageOps(8192)
+	defer ops.Close()
+
+	jpegOpts := base
+	jpegOpts.FileType = ".jpeg"
+	jpegOpts.EncodeOptions = EncodeOptions[".jpeg"]
+
+	buf := make([]byte, 50*1024*1024)
+	return ops.Transform(decoder, &jpegOpts, buf)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// imageExtensions lists the file extensions walked and processed when -i
+// points at a directory.
+var imageExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+}
+
+// BatchStats aggregates the results of a recursive run for the summary table.
+type BatchStats struct {
+	Count          int
+	Kept           int
+	Errors         int
+	InputBytes     int64
+	OutputBytes    int64
+	PostSavedBytes int64
+	MetadataBytes  int64
+	Elapsed        time.Duration
+}
+
+// collectImages walks root and returns every file with a recognized image
+// extension.
+func collectImages(root string) ([]string, error) {
+	var paths []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if imageExtensions[strings.ToLower(filepath.Ext(path))] {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// outputPathFor computes the destination for a file found while walking root.
+// With outDir set, the path relative to root is mirrored underneath it;
+// otherwise the usual "_opt" sibling convention is used.
+func outputPathFor(path, root, outDir string) (string, error) {
+	if outDir == "" {
+		ext := filepath.Ext(path)
+		return strings.TrimSuffix(path, ext) + "_opt" + ext, nil
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(outDir, rel), nil
+}
+
+// runBatch walks opts.inputFilename recursively, running processFile over
+// every recognized image with up to opts.jobs workers pulling from a shared
+// channel, then prints an aggregate summary table.
+func runBatch(opts Options) error {
+	paths, err := collectImages(opts.inputFilename)
+	if err != nil {
+		return fmt.Errorf("error walking %s: %s", opts.inputFilename, err)
+	}
+	if len(paths) == 0 {
+		fmt.Println("no image files found")
+		return nil
+	}
+
+	jobs := opts.jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	if opts.outDir != "" && !opts.noAction {
+		if err := os.MkdirAll(opts.outDir, 0755); err != nil {
+			return fmt.Errorf("error creating output directory %s: %s", opts.outDir, err)
+		}
+	}
+
+	type result struct {
+		path  string
+		stats FileStats
+		err   error
+	}
+
+	pathCh := make(chan string)
+	resultCh := make(chan result)
+
+	var wg sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range pathCh {
+				outPath, err := outputPathFor(path, opts.inputFilename, opts.outDir)
+				if err != nil {
+					resultCh <- result{path: path, err: err}
+					continue
+				}
+				if opts.outDir != "" && !opts.noAction {
+					if err := os.MkdirAll(filepath.Dir(outPath), 0755); err != nil {
+						resultCh <- result{path: path, err: err}
+						continue
+					}
+				}
+
+				fileOpts := opts
+				fileOpts.inputFilename = path
+				fileOpts.outputFilename = outPath
+
+				stats, err := processFile(fileOpts)
+				resultCh <- result{path: path, stats: stats, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, path := range paths {
+			pathCh <- path
+		}
+		close(pathCh)
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	var total BatchStats
+	for res := range resultCh {
+		if res.err != nil {
+			fmt.Fprintf(os.Stderr, "error processing %s: %s\n", res.path, res.err)
+			total.Errors++
+			continue
+		}
+		total.Count++
+		total.InputBytes += int64(res.stats.InputBytes)
+		total.OutputBytes += int64(res.stats.OutputBytes)
+		total.PostSavedBytes += int64(res.stats.PostSavedBytes)
+		total.MetadataBytes += int64(res.stats.MetadataBytes)
+		total.Elapsed += res.stats.Elapsed
+		if res.stats.Kept {
+			total.Kept++
+			fmt.Printf("%s kept original (%s)\n", res.stats.InputPath, res.stats.KeptReason)
+		} else {
+			fmt.Printf("%s -> %s (%s -> %s)\n", res.stats.InputPath, res.stats.OutputPath,
+				Humanize(res.stats.InputBytes), Humanize(res.stats.OutputBytes))
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', 0)
+	fmt.Fprintf(w, "Files Processed\t%d\n", total.Count)
+	if total.Kept > 0 {
+		fmt.Fprintf(w, "Files Kept Original\t%d\n", total.Kept)
+	}
+	if total.Errors > 0 {
+		fmt.Fprintf(w, "Files Failed\t%d\n", total.Errors)
+	}
+	fmt.Fprintf(w, "Total Input Size\t%s\n", Humanize(int(total.InputBytes)))
+	fmt.Fprintf(w, "Total Output Size\t%s\n", Humanize(int(total.OutputBytes)))
+	if total.PostSavedBytes > 0 {
+		fmt.Fprintf(w, "Post-Process Savings\t%s\n", Humanize(int(total.PostSavedBytes)))
+	}
+	if total.MetadataBytes > 0 {
+		fmt.Fprintf(w, "Metadata Stripped\t%s\n", Humanize(int(total.MetadataBytes)))
+	}
+	if total.InputBytes > 0 {
+		fmt.Fprintf(w, "Total Size Reduction\t%.1f%%\n",
+			100.0-(float64(total.OutputBytes)/float64(total.InputBytes)*100))
+	}
+	fmt.Fprintf(w, "Elapsed\t%s\n", total.Elapsed.Round(time.Millisecond))
+	w.Flush()
+
+	return nil
+}
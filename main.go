@@ -17,21 +17,50 @@ import (
 const debug_mode bool = false
 
 type Options struct {
-	version        bool
-	debug          bool
-	inputFilename  string
-	outputFilename string
-	outputWidth    int
-	outputHeight   int
-	maxWidth       int
-	maxHeight      int
-	maxLongest     int
-	minShortest    int
-	pctResize      float64
-	stretch        bool
-	force          bool
-	noAction       bool
-	additionalArgs []string
+	version         bool
+	debug           bool
+	inputFilename   string
+	outputFilename  string
+	outputWidth     int
+	outputHeight    int
+	maxWidth        int
+	maxHeight       int
+	maxLongest      int
+	minShortest     int
+	pctResize       float64
+	stretch         bool
+	force           bool
+	noAction        bool
+	recursive       bool
+	jobs            int
+	outDir          string
+	diff            float64
+	animated        string
+	post            bool
+	postOnly        string
+	autoFormat      bool
+	strip           string
+	keepOrientation bool
+	additionalArgs  []string
+}
+
+// FileStats holds the result of processing a single file, used both for the
+// single-file summary table and for aggregation across a batch run.
+type FileStats struct {
+	InputPath      string
+	OutputPath     string
+	InputBytes     int
+	OutputBytes    int
+	InputWidth     int
+	InputHeight    int
+	OutputWidth    int
+	OutputHeight   int
+	Kept           bool   // true when the original was kept unchanged, see KeptReason
+	KeptReason     string // human-readable reason the output wasn't written
+	PostProcessed  bool   // true when an external optimizer ran against the output
+	PostSavedBytes int    // additional bytes trimmed by the post-process pass
+	MetadataBytes  int    // EXIF/ICC/XMP bytes dropped per -strip
+	Elapsed        time.Duration
 }
 
 var EncodeOptions = map[string]map[int]int{
@@ -123,6 +152,16 @@ func init() {
 	flag.BoolVar(&opt.force, "f", false, "overwrite output file if it exists")
 	flag.BoolVar(&opt.debug, "d", false, "print debug messages to console")
 	flag.BoolVar(&opt.noAction, "n", false, "don't write files; just display results")
+	flag.BoolVar(&opt.recursive, "r", false, "recurse into -i when it is a directory")
+	flag.IntVar(&opt.jobs, "j", 1, "number of files to process concurrently when recursing")
+	flag.StringVar(&opt.outDir, "out-dir", "", "mirror -i's directory tree under this destination when recursing")
+	flag.Float64Var(&opt.diff, "diff", 0, "minimum % size reduction required to write the output; otherwise keep the original")
+	flag.StringVar(&opt.animated, "animated", "skip", "how to handle animated GIF/WebP input: skip, resize, or firstframe")
+	flag.BoolVar(&opt.post, "post", false, "run external optimizers (jpegoptim/optipng/gifsicle/cwebp) on the output after transform")
+	flag.StringVar(&opt.postOnly, "post-only", "", "restrict -post to this comma-separated list of extensions, e.g. jpg,png")
+	flag.BoolVar(&opt.autoFormat, "auto-format", false, "transcode opaque PNG/GIF input to JPEG when it comes out smaller")
+	flag.StringVar(&opt.strip, "strip", "all", "metadata handling: all, exif (keep ICC color profile), or none (keep everything)")
+	flag.BoolVar(&opt.keepOrientation, "keep-orientation", false, "don't normalize EXIF orientation; the rotation tag itself is carried over only with -strip=none")
 	flag.Parse()
 	opt.additionalArgs = flag.Args()
 
@@ -131,32 +170,31 @@ func init() {
 	}
 }
 
-func main() {
-	log.Printf("Command line options: %+v", opt)
-
-	if opt.inputFilename == "" {
-		fmt.Println("No input filename provided, quitting.")
-		flag.Usage()
-		os.Exit(1)
+// processFile runs the full decode/resize/transcode/write pipeline for a
+// single image described by opts.inputFilename, writing to opts.outputFilename
+// (or a derived "_opt" sibling if unset). It returns the resulting FileStats
+// so callers can print a single-file table or fold the result into a batch
+// summary.
+func processFile(opts Options) (FileStats, error) {
+	start := time.Now()
+
+	outputFilename := opts.outputFilename
+	if outputFilename == "" {
+		ext := filepath.Ext(opts.inputFilename)
+		outputFilename = strings.TrimSuffix(opts.inputFilename, ext) + "_opt" + ext
 	}
 
+	stats := FileStats{InputPath: opts.inputFilename, OutputPath: outputFilename}
+
 	// decoder wants []byte, so read the whole file into a buffer
-	inputBuf, err := ioutil.ReadFile(opt.inputFilename)
+	inputBuf, err := ioutil.ReadFile(opts.inputFilename)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to read input file, %s\n", err)
-		os.Exit(1)
-	}
-
-	// check if output file is valid
-	if opt.outputFilename == "" {
-		ext := filepath.Ext(opt.inputFilename)
-		opt.outputFilename = strings.TrimSuffix(opt.inputFilename, ext) + "_opt" + ext
+		return stats, fmt.Errorf("failed to read input file, %s", err)
 	}
 
-	if !opt.noAction {
-		if err := validateOutputFile(opt.outputFilename, opt.force); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+	if !opts.noAction {
+		if err := validateOutputFile(outputFilename, opts.force); err != nil {
+			return stats, err
 		}
 	} else {
 		fmt.Println("**Displaying results only**")
@@ -166,8 +204,7 @@ func main() {
 	// this error reflects very basic checks,
 	// mostly just for the magic bytes of the file to match known image formats
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error decoding image: %s\n", err)
-		os.Exit(1)
+		return stats, fmt.Errorf("error decoding image: %s", err)
 	}
 	defer decoder.Close()
 
@@ -175,14 +212,26 @@ func main() {
 	// this error is much more comprehensive and reflects
 	// format errors
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error reading image header: %s\n", err)
-		os.Exit(1)
+		return stats, fmt.Errorf("error reading image header: %s", err)
 	}
+	stats.InputWidth = header.Width()
+	stats.InputHeight = header.Height()
 
-	if decoder.Duration() != 0 {
+	animated := decoder.Duration() != 0
+	if animated {
 		fmt.Printf("duration: %.2f s\n", float64(decoder.Duration())/float64(time.Second))
 	}
 
+	if animated && opts.animated == "skip" {
+		stats.Kept = true
+		stats.KeptReason = "animated input not resized (-animated=skip)"
+		stats.OutputPath = opts.inputFilename
+		stats.InputBytes = len(inputBuf)
+		stats.OutputBytes = stats.InputBytes
+		stats.Elapsed = time.Since(start)
+		return stats, nil
+	}
+
 	// get ready to resize image,
 	// using 8192x8192 maximum resize buffer size
 	ops := lilliput.NewImageOps(8192)
@@ -193,99 +242,218 @@ func main() {
 
 	// use user supplied filename to guess output type if provided
 	// otherwise don't transcode (use existing type)
-	outputType := "." + strings.ToLower(decoder.Description())
-	if opt.outputFilename != "" {
-		outputType = filepath.Ext(opt.outputFilename)
+	sourceType := "." + strings.ToLower(decoder.Description())
+	outputType := sourceType
+	if outputFilename != "" {
+		outputType = filepath.Ext(outputFilename)
 	}
 
-	if opt.maxLongest > 0 {
+	if opts.maxLongest > 0 {
 		// calculate longest dim, and assign to pctResize
-		if longest := Max(header.Width(), header.Height()); longest > opt.maxLongest {
-			fmt.Printf("Resizing to longest dimension of %d px\n", opt.maxLongest)
-			opt.pctResize = (float64(opt.maxLongest) / float64(longest)) * float64(100)
+		if longest := Max(header.Width(), header.Height()); longest > opts.maxLongest {
+			fmt.Printf("Resizing to longest dimension of %d px\n", opts.maxLongest)
+			opts.pctResize = (float64(opts.maxLongest) / float64(longest)) * float64(100)
 		}
 	}
 
-	if opt.minShortest > 0 {
+	if opts.minShortest > 0 {
 		// calculate longest dim, and assign to pctResize
-		if shortest := Min(header.Width(), header.Height()); shortest > opt.minShortest {
-			fmt.Printf("Resizing shortest dimension to %d px\n", opt.minShortest)
-			opt.pctResize = (float64(opt.minShortest) / float64(shortest)) * float64(100)
+		if shortest := Min(header.Width(), header.Height()); shortest > opts.minShortest {
+			fmt.Printf("Resizing shortest dimension to %d px\n", opts.minShortest)
+			opts.pctResize = (float64(opts.minShortest) / float64(shortest)) * float64(100)
 		}
 	}
 
-	opt.outputWidth = (func() int {
-		if opt.pctResize > 0 {
-			return Scale(opt.pctResize, header.Width())
+	outputWidth := (func() int {
+		if opts.pctResize > 0 {
+			return Scale(opts.pctResize, header.Width())
 		}
-		if opt.maxWidth > 0 {
-			return opt.maxWidth
+		if opts.maxWidth > 0 {
+			return opts.maxWidth
 		}
-		if opt.outputWidth == 0 {
+		if opts.outputWidth == 0 {
 			return header.Width()
 		}
-		return opt.outputWidth
+		return opts.outputWidth
 	})()
 
-	opt.outputHeight = (func() int {
-		if opt.pctResize > 0 {
-			return Scale(opt.pctResize, header.Height())
+	outputHeight := (func() int {
+		if opts.pctResize > 0 {
+			return Scale(opts.pctResize, header.Height())
 		}
-		if opt.maxHeight > 0 {
-			return opt.maxHeight
+		if opts.maxHeight > 0 {
+			return opts.maxHeight
 		}
-		if opt.outputHeight == 0 {
+		if opts.outputHeight == 0 {
 			return header.Height()
 		}
-		return opt.outputHeight
+		return opts.outputHeight
 	})()
 
 	resizeMethod := lilliput.ImageOpsFit
-	if opt.stretch {
+	if opts.stretch {
 		resizeMethod = lilliput.ImageOpsResize
 	}
 
-	if opt.outputWidth == header.Width() && opt.outputHeight == header.Height() {
+	if outputWidth == header.Width() && outputHeight == header.Height() {
 		resizeMethod = lilliput.ImageOpsNoResize
 	}
 
-	opts := &lilliput.ImageOptions{
-		FileType:             outputType,
-		Width:                opt.outputWidth,
-		Height:               opt.outputHeight,
-		ResizeMethod:         resizeMethod,
-		NormalizeOrientation: true,
-		EncodeOptions:        EncodeOptions[outputType],
+	ilOpts := &lilliput.ImageOptions{
+		FileType:              outputType,
+		Width:                 outputWidth,
+		Height:                outputHeight,
+		ResizeMethod:          resizeMethod,
+		NormalizeOrientation:  !opts.keepOrientation,
+		EncodeOptions:         EncodeOptions[outputType],
+		DisableAnimatedOutput: animated && opts.animated == "firstframe",
 	}
 
 	// resize and transcode image
-	outputImg, err = ops.Transform(decoder, opts, outputImg)
+	outputImg, err = ops.Transform(decoder, ilOpts, outputImg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error transforming image: %s\n", err)
+		return stats, fmt.Errorf("error transforming image: %s", err)
+	}
+
+	if opts.autoFormat && !animated && autoFormatSources[sourceType] && outputType != ".jpeg" && outputType != ".jpg" {
+		if !header.HasAlpha() {
+			if altImg, aerr := tryJPEGAlternative(inputBuf, *ilOpts); aerr == nil && len(altImg) < len(outputImg) {
+				saved := len(outputImg) - len(altImg)
+				outputImg = altImg
+				outputFilename = strings.TrimSuffix(outputFilename, filepath.Ext(outputFilename)) + ".jpeg"
+				outputType = ".jpeg"
+				stats.OutputPath = outputFilename
+
+				if !opts.noAction {
+					if err := validateOutputFile(outputFilename, opts.force); err != nil {
+						return stats, err
+					}
+				}
+
+				fmt.Printf("auto-format: %s is opaque, using JPEG instead (saved an additional %s)\n",
+					opts.inputFilename, Humanize(saved))
+			}
+		}
+	}
+
+	outputImg, stats.MetadataBytes = applyMetadataPolicy(inputBuf, outputImg, sourceType, outputType, opts.strip)
+	if stats.MetadataBytes > 0 {
+		fmt.Printf("metadata: dropped %s of metadata from %s per -strip=%s\n",
+			Humanize(stats.MetadataBytes), opts.inputFilename, opts.strip)
+	}
+
+	stats.OutputWidth = outputWidth
+	stats.OutputHeight = outputHeight
+	stats.InputBytes = len(inputBuf)
+
+	reduction := 100.0 - (float64(len(outputImg)) / float64(stats.InputBytes) * 100)
+	if opts.diff > 0 && reduction < opts.diff {
+		stats.Kept = true
+		stats.KeptReason = fmt.Sprintf("reduction below -diff %.1f%% threshold", opts.diff)
+		stats.OutputPath = opts.inputFilename
+		stats.OutputBytes = stats.InputBytes
+	} else {
+		stats.OutputBytes = len(outputImg)
+		if !opts.noAction {
+			if err := ioutil.WriteFile(outputFilename, outputImg, 0644); err != nil {
+				return stats, fmt.Errorf("error writing resized image: %s", err)
+			}
+			if opts.post {
+				before, after, metaDropped, ran, err := postProcess(outputFilename, opts)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "post-process warning for %s: %s\n", outputFilename, err)
+				} else if ran {
+					stats.PostProcessed = true
+					stats.PostSavedBytes = before - after
+					if stats.PostSavedBytes > 0 {
+						fmt.Printf("post-process: %s saved an additional %s\n", outputFilename, Humanize(stats.PostSavedBytes))
+					}
+					if metaDropped > 0 {
+						stats.MetadataBytes += metaDropped
+						fmt.Printf("post-process: %s also dropped an additional %s of metadata\n", outputFilename, Humanize(metaDropped))
+					}
+					stats.OutputBytes = after
+					log.Printf("Post-process buf size: %d -> %d", before, after)
+				}
+			}
+		}
+	}
+
+	stats.Elapsed = time.Since(start)
+
+	log.Printf("Input buf size: %d", stats.InputBytes)
+	log.Printf("Output buf size: %d", stats.OutputBytes)
+
+	return stats, nil
+}
+
+func main() {
+	log.Printf("Command line options: %+v", opt)
+
+	if opt.inputFilename == "" {
+		fmt.Println("No input filename provided, quitting.")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch opt.animated {
+	case "skip", "resize", "firstframe":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -animated value %q; must be skip, resize, or firstframe\n", opt.animated)
+		os.Exit(1)
+	}
+
+	switch opt.strip {
+	case "all", "exif", "none":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -strip value %q; must be all, exif, or none\n", opt.strip)
+		os.Exit(1)
+	}
+
+	info, err := os.Stat(opt.inputFilename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read input path, %s\n", err)
 		os.Exit(1)
 	}
 
-	if !opt.noAction {
-		err = ioutil.WriteFile(opt.outputFilename, outputImg, 0644)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error writing resized image: %s\n", err)
+	if info.IsDir() {
+		if !opt.recursive {
+			fmt.Fprintf(os.Stderr, "%s is a directory; pass -r to process it recursively\n", opt.inputFilename)
+			os.Exit(1)
+		}
+		if err := runBatch(opt); err != nil {
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
+		return
 	}
 
-	inputSize := len(inputBuf)
-	outputSize := len(outputImg)
-	log.Printf("Input buf size: %d", inputSize)
-	log.Printf("Output buf size: %d", outputSize)
+	stats, err := processFile(opt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	// print some basic info about the image
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 4, ' ', 0)
 
-	fmt.Fprintf(w, "File Name\t%s\t -> \t%s\n", opt.inputFilename, opt.outputFilename)
-	fmt.Fprintf(w, "File Dimensions\t%d x %d px\t -> \t%d x %d px\n",
-		header.Width(), header.Height(), opt.outputWidth, opt.outputHeight)
-	fmt.Fprintf(w, "File Size\t%s\t -> \t%s\n", Humanize(inputSize), Humanize(outputSize))
-	fmt.Fprintf(w, "Size Reduction\t%.1f%%", 100.0-(float64(outputSize)/float64(inputSize)*100))
+	if stats.Kept {
+		fmt.Fprintf(w, "File Name\t%s\t -> \tkept original\n", stats.InputPath)
+		fmt.Fprintf(w, "File Dimensions\t%d x %d px\n", stats.InputWidth, stats.InputHeight)
+		fmt.Fprintf(w, "File Size\t%s\t (%s)", Humanize(stats.InputBytes), stats.KeptReason)
+	} else {
+		fmt.Fprintf(w, "File Name\t%s\t -> \t%s\n", stats.InputPath, stats.OutputPath)
+		fmt.Fprintf(w, "File Dimensions\t%d x %d px\t -> \t%d x %d px\n",
+			stats.InputWidth, stats.InputHeight, stats.OutputWidth, stats.OutputHeight)
+		fmt.Fprintf(w, "File Size\t%s\t -> \t%s\n", Humanize(stats.InputBytes), Humanize(stats.OutputBytes))
+		if stats.PostProcessed && stats.PostSavedBytes > 0 {
+			fmt.Fprintf(w, "Post-Process Savings\t%s\n", Humanize(stats.PostSavedBytes))
+		}
+		if stats.MetadataBytes > 0 {
+			fmt.Fprintf(w, "Metadata Stripped\t%s\n", Humanize(stats.MetadataBytes))
+		}
+		fmt.Fprintf(w, "Size Reduction\t%.1f%%", 100.0-(float64(stats.OutputBytes)/float64(stats.InputBytes)*100))
+	}
 
 	w.Flush()     // write details table
 	fmt.Println() // newline separator
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// jpegMetadata holds the raw marker segments (including the 0xFFEn header and
+// length bytes) extracted from a source JPEG, so they can be spliced back
+// into the re-encoded output verbatim.
+type jpegMetadata struct {
+	exif []byte
+	icc  []byte
+	xmp  []byte
+}
+
+var (
+	exifIdentifier = []byte("Exif\x00\x00")
+	xmpIdentifier  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	iccIdentifier  = []byte("ICC_PROFILE\x00")
+)
+
+// extractJPEGMetadata walks buf's marker segments looking for the EXIF, XMP,
+// and ICC APPn segments, stopping at the start-of-scan marker where the
+// compressed image data begins.
+func extractJPEGMetadata(buf []byte) jpegMetadata {
+	var md jpegMetadata
+	if len(buf) < 4 || buf[0] != 0xFF || buf[1] != 0xD8 {
+		return md
+	}
+
+	pos := 2
+	for pos+4 <= len(buf) {
+		if buf[pos] != 0xFF {
+			break
+		}
+		marker := buf[pos+1]
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8) {
+			pos += 2
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+
+		length := int(binary.BigEndian.Uint16(buf[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(buf) {
+			break
+		}
+		segment := buf[pos : pos+2+length]
+		payload := buf[pos+4 : pos+2+length]
+
+		switch {
+		case marker == 0xE1 && hasPrefix(payload, exifIdentifier):
+			md.exif = append(md.exif, segment...)
+		case marker == 0xE1 && hasPrefix(payload, xmpIdentifier):
+			md.xmp = append(md.xmp, segment...)
+		case marker == 0xE2 && hasPrefix(payload, iccIdentifier):
+			md.icc = append(md.icc, segment...)
+		}
+
+		pos += 2 + length
+	}
+	return md
+}
+
+// spliceJPEGMetadata inserts the given marker segments immediately after the
+// SOI marker of a freshly-encoded JPEG.
+func spliceJPEGMetadata(out []byte, segments ...[]byte) []byte {
+	if len(out) < 2 || out[0] != 0xFF || out[1] != 0xD8 {
+		return out
+	}
+	spliced := append([]byte{}, out[:2]...)
+	for _, seg := range segments {
+		spliced = append(spliced, seg...)
+	}
+	return append(spliced, out[2:]...)
+}
+
+// pngMetadataChunkTypes lists the ancillary PNG chunks that carry metadata
+// rather than pixel data.
+var pngMetadataChunkTypes = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"iCCP": true,
+	"eXIf": true,
+}
+
+// extractPNGMetadata returns the raw bytes (length+type+data+crc) of every
+// metadata chunk in buf, stopping once pixel data (IDAT) is reached.
+func extractPNGMetadata(buf []byte) [][]byte {
+	var chunks [][]byte
+	pos := 8
+	for pos+8 <= len(buf) {
+		length := int(binary.BigEndian.Uint32(buf[pos : pos+4]))
+		typ := string(buf[pos+4 : pos+8])
+		end := pos + 8 + length + 4
+		if end > len(buf) {
+			break
+		}
+		if pngMetadataChunkTypes[typ] {
+			chunks = append(chunks, append([]byte{}, buf[pos:end]...))
+		}
+		if typ == "IDAT" || typ == "IEND" {
+			break
+		}
+		pos = end
+	}
+	return chunks
+}
+
+// splicePNGMetadata inserts chunks immediately after the IHDR chunk of a
+// freshly-encoded PNG.
+func splicePNGMetadata(out []byte, chunks [][]byte) []byte {
+	if len(chunks) == 0 || len(out) < 8 {
+		return out
+	}
+	pos := 8
+	if pos+8 > len(out) {
+		return out
+	}
+	length := int(binary.BigEndian.Uint32(out[pos : pos+4]))
+	ihdrEnd := pos + 8 + length + 4
+	if ihdrEnd > len(out) {
+		return out
+	}
+	spliced := append([]byte{}, out[:ihdrEnd]...)
+	for _, c := range chunks {
+		spliced = append(spliced, c...)
+	}
+	return append(spliced, out[ihdrEnd:]...)
+}
+
+func hasPrefix(b, prefix []byte) bool {
+	if len(b) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if b[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// applyMetadataPolicy re-applies the EXIF/ICC/XMP metadata dropped by
+// lilliput's re-encode according to opts.strip: "none" restores everything,
+// "exif" keeps only the ICC color profile, "all" (the default) restores
+// nothing. It returns the (possibly unchanged) output buffer and the number
+// of metadata bytes that were found in the source but not carried over.
+func applyMetadataPolicy(inputBuf, outputImg []byte, sourceType, outputType string, strip string) ([]byte, int) {
+	norm := func(t string) string {
+		if t = strings.ToLower(t); t == ".jpg" {
+			return ".jpeg"
+		}
+		return t
+	}
+	if strip == "all" || norm(sourceType) != norm(outputType) {
+		dropped := 0
+		switch norm(sourceType) {
+		case ".jpeg":
+			md := extractJPEGMetadata(inputBuf)
+			dropped = len(md.exif) + len(md.icc) + len(md.xmp)
+		case ".png":
+			for _, c := range extractPNGMetadata(inputBuf) {
+				dropped += len(c)
+			}
+		}
+		return outputImg, dropped
+	}
+
+	switch sourceType {
+	case ".jpeg", ".jpg":
+		md := extractJPEGMetadata(inputBuf)
+		var keep [][]byte
+		dropped := 0
+		if strip == "none" {
+			for _, seg := range [][]byte{md.exif, md.icc, md.xmp} {
+				if len(seg) > 0 {
+					keep = append(keep, seg)
+				}
+			}
+		} else { // "exif": keep color profile, drop EXIF/XMP
+			if len(md.icc) > 0 {
+				keep = append(keep, md.icc)
+			}
+			dropped = len(md.exif) + len(md.xmp)
+		}
+		return spliceJPEGMetadata(outputImg, keep...), dropped
+
+	case ".png":
+		chunks := extractPNGMetadata(inputBuf)
+		var keep [][]byte
+		dropped := 0
+		for _, c := range chunks {
+			typ := string(c[4:8])
+			if strip == "none" || typ == "iCCP" {
+				keep = append(keep, c)
+			} else {
+				dropped += len(c)
+			}
+		}
+		return splicePNGMetadata(outputImg, keep), dropped
+	}
+
+	return outputImg, 0
+}
+
+// metadataSize reads the file at path and reports how many bytes of
+// EXIF/ICC/XMP metadata it currently carries. Used to detect when a
+// post-process tool (e.g. jpegoptim) drops metadata beyond what -strip
+// already accounted for.
+func metadataSize(path string) int {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpeg", ".jpg":
+		md := extractJPEGMetadata(buf)
+		return len(md.exif) + len(md.icc) + len(md.xmp)
+	case ".png":
+		total := 0
+		for _, c := range extractPNGMetadata(buf) {
+			total += len(c)
+		}
+		return total
+	}
+	return 0
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/discordapp/lilliput"
+)
+
+// PostProcessor shells out to a native tool to squeeze extra bytes out of an
+// already-encoded image, beyond what lilliput's own encoders leave on the
+// table.
+type PostProcessor interface {
+	// Available reports whether the underlying binary is installed.
+	Available() bool
+	// Run optimizes the file at inPath, leaving the result at outPath. opts
+	// carries the user's -strip policy so a processor doesn't undo metadata
+	// that was deliberately preserved.
+	Run(inPath, outPath string, opts Options) error
+}
+
+// postProcessors maps an output extension to the tool that optimizes it.
+var postProcessors = map[string]PostProcessor{
+	".jpg":  jpegoptimProcessor{},
+	".jpeg": jpegoptimProcessor{},
+	".png":  optipngProcessor{},
+	".gif":  gifsicleProcessor{},
+	".webp": cwebpProcessor{},
+}
+
+type jpegoptimProcessor struct{}
+
+func (jpegoptimProcessor) Available() bool { return lookPath("jpegoptim") }
+
+func (jpegoptimProcessor) Run(inPath, outPath string, opts Options) error {
+	if err := copyIfDifferent(inPath, outPath); err != nil {
+		return err
+	}
+	quality := EncodeOptions[".jpeg"][lilliput.JpegQuality]
+	if quality == 0 {
+		quality = 85
+	}
+
+	var args []string
+	switch opts.strip {
+	case "none":
+		// no --strip-* flags: jpegoptim leaves markers untouched by default
+	case "exif":
+		args = append(args, "--strip-exif", "--strip-xmp") // keep the ICC profile
+	default: // "all"
+		args = append(args, "--strip-all")
+	}
+	args = append(args, fmt.Sprintf("-m%d", quality), outPath)
+
+	cmd := exec.Command("jpegoptim", args...)
+	return cmd.Run()
+}
+
+type optipngProcessor struct{}
+
+func (optipngProcessor) Available() bool { return lookPath("optipng") }
+
+func (optipngProcessor) Run(inPath, outPath string, opts Options) error {
+	if err := copyIfDifferent(inPath, outPath); err != nil {
+		return err
+	}
+	cmd := exec.Command("optipng", "-quiet", "-o7", outPath)
+	return cmd.Run()
+}
+
+type gifsicleProcessor struct{}
+
+func (gifsicleProcessor) Available() bool { return lookPath("gifsicle") }
+
+func (gifsicleProcessor) Run(inPath, outPath string, opts Options) error {
+	return runToTempAndReplace(outPath, func(tmp string) *exec.Cmd {
+		return exec.Command("gifsicle", "-O3", inPath, "-o", tmp)
+	})
+}
+
+type cwebpProcessor struct{}
+
+func (cwebpProcessor) Available() bool { return lookPath("cwebp") }
+
+func (cwebpProcessor) Run(inPath, outPath string, opts Options) error {
+	return runToTempAndReplace(outPath, func(tmp string) *exec.Cmd {
+		quality := EncodeOptions[".webp"][lilliput.WebpQuality]
+		if quality == 0 {
+			quality = 85
+		}
+		return exec.Command("cwebp", "-q", fmt.Sprintf("%d", quality), inPath, "-o", tmp)
+	})
+}
+
+func lookPath(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// copyIfDifferent copies src to dst when the two paths differ, for tools
+// (jpegoptim, optipng) that optimize a file in place rather than accepting
+// separate input/output paths.
+func copyIfDifferent(src, dst string) error {
+	if src == dst {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, buf, 0644)
+}
+
+// runToTempAndReplace runs the command built by build against a temp file
+// next to outPath, then atomically renames it over outPath on success. This
+// keeps tools that require a distinct -o path from fighting over a file
+// that's still being read.
+func runToTempAndReplace(outPath string, build func(tmp string) *exec.Cmd) error {
+	tmp := outPath + ".post-tmp"
+	defer os.Remove(tmp)
+
+	if err := build(tmp).Run(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, outPath)
+}
+
+// postOnlySet parses the comma-separated -post-only flag value into a set of
+// bare extensions (no leading dot). An empty raw value means "no restriction".
+func postOnlySet(raw string) map[string]bool {
+	if raw == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, ext := range strings.Split(raw, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		ext = strings.TrimPrefix(ext, ".")
+		if ext != "" {
+			set[ext] = true
+		}
+	}
+	return set
+}
+
+// postProcess looks up the registered PostProcessor for path's extension and,
+// if it's available and not excluded by -post-only, runs it. It returns the
+// file size before and after, any extra metadata bytes the tool dropped
+// beyond what -strip already accounted for, and whether a processor actually
+// ran.
+func postProcess(path string, opts Options) (before, after, metadataDropped int, ran bool, err error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	proc, ok := postProcessors[ext]
+	if !ok {
+		return 0, 0, 0, false, nil
+	}
+
+	if only := postOnlySet(opts.postOnly); only != nil && !only[strings.TrimPrefix(ext, ".")] {
+		return 0, 0, 0, false, nil
+	}
+
+	if !proc.Available() {
+		return 0, 0, 0, false, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	before = int(info.Size())
+	metadataBefore := metadataSize(path)
+
+	if err := proc.Run(path, path, opts); err != nil {
+		return before, before, 0, false, err
+	}
+
+	info, err = os.Stat(path)
+	if err != nil {
+		return before, before, 0, false, err
+	}
+	after = int(info.Size())
+
+	if dropped := metadataBefore - metadataSize(path); dropped > 0 {
+		metadataDropped = dropped
+	}
+
+	return before, after, metadataDropped, true, nil
+}